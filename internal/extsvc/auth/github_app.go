@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/sourcegraph/sourcegraph/internal/httpcli"
+)
+
+// jwtMaxAge and tokenRefreshSkew bound the lifetime of the two tokens
+// GitHubAppInstallation juggles: the JWT it signs itself (GitHub caps these
+// at 10 minutes) and the installation token it exchanges that JWT for.
+const (
+	// jwtMaxAge keeps the app JWT's iat/exp window comfortably inside
+	// GitHub's 10 minute limit, leaving room for clock drift between us and
+	// GitHub.
+	jwtMaxAge = 9 * time.Minute
+	// jwtClockDrift backdates iat slightly, since GitHub rejects a JWT whose
+	// iat is in the future from its point of view.
+	jwtClockDrift = 30 * time.Second
+	// tokenRefreshSkew is how long before its real expiry an installation
+	// token is treated as expired, so a request doesn't race a token that's
+	// about to be rejected.
+	tokenRefreshSkew = time.Minute
+)
+
+// GitHubAppInstallation authenticates requests as a GitHub App installation:
+// it signs a short-lived JWT with the App's private key, exchanges it for an
+// installation access token via POST /app/installations/{id}/access_tokens,
+// and transparently refreshes that token shortly before it expires. This is
+// the right Authenticator for server-to-server usage, since installation
+// tokens are subject to the App's own 5,000 req/hour-per-installation limit
+// rather than a per-user PAT's limit.
+type GitHubAppInstallation struct {
+	// AppID is the GitHub App's numeric ID.
+	AppID int64
+	// InstallationID is the ID of the installation this authenticator acts as.
+	InstallationID int64
+	// PrivateKey is the App's RSA private key, used to sign the JWT
+	// exchanged for installation tokens.
+	PrivateKey *rsa.PrivateKey
+
+	// APIURL is the base URL of the GitHub API to mint tokens against.
+	// Defaults to https://api.github.com; set for GitHub Enterprise.
+	APIURL string
+
+	// Doer issues the token-exchange HTTP request. Defaults to
+	// httpcli.ExternalDoer.
+	Doer httpcli.Doer
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// Hash implements Authenticator. It's derived from the app and installation
+// IDs rather than the current installation token, so it stays stable across
+// refreshes: V4Client and ratelimit.Monitor key their caches and registries
+// on Hash(), and a new value on every refresh would churn both for no
+// reason.
+func (g *GitHubAppInstallation) Hash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("github-app-installation:%d:%d", g.AppID, g.InstallationID)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate adds a valid installation access token to req, minting or
+// refreshing it first if necessary.
+func (g *GitHubAppInstallation) Authenticate(req *http.Request) error {
+	token, err := g.installationToken(req.Context())
+	if err != nil {
+		return errors.Wrap(err, "getting github app installation token")
+	}
+	req.Header.Set("Authorization", "token "+token)
+	return nil
+}
+
+// installationToken returns a cached installation token if it's still
+// fresh, minting a new one via signJWT and exchangeForInstallationToken
+// otherwise.
+func (g *GitHubAppInstallation) installationToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.token != "" && time.Now().Before(g.expiresAt.Add(-tokenRefreshSkew)) {
+		return g.token, nil
+	}
+
+	jwt, err := g.signJWT(time.Now())
+	if err != nil {
+		return "", errors.Wrap(err, "signing app JWT")
+	}
+
+	token, expiresAt, err := g.exchangeForInstallationToken(ctx, jwt)
+	if err != nil {
+		return "", err
+	}
+
+	g.token = token
+	g.expiresAt = expiresAt
+	return g.token, nil
+}
+
+// signJWT mints the RS256 app JWT GitHub requires to authorize the
+// access_tokens exchange, with iat/exp within GitHub's 10 minute cap.
+func (g *GitHubAppInstallation) signJWT(now time.Time) (string, error) {
+	headerJSON, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-jwtClockDrift).Unix(),
+		"exp": now.Add(jwtMaxAge).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	// The "iss" claim is a string in the JWT spec, so it's set separately
+	// from the numeric claims above.
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return "", err
+	}
+	claims["iss"] = strconv.FormatInt(g.AppID, 10)
+	claimsJSON, err = json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	hashed := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.PrivateKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// exchangeForInstallationToken calls GitHub's access_tokens endpoint to
+// trade the app JWT for an installation token good for about an hour.
+func (g *GitHubAppInstallation) exchangeForInstallationToken(ctx context.Context, jwt string) (string, time.Time, error) {
+	apiURL := g.APIURL
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", strings.TrimSuffix(apiURL, "/"), g.InstallationID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	doer := g.Doer
+	if doer == nil {
+		doer = httpcli.ExternalDoer
+	}
+
+	resp, err := doer.Do(req)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "requesting installation token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", time.Time{}, errors.Newf("github: minting installation token failed with status %s", resp.Status)
+	}
+
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "decoding installation token response")
+	}
+
+	return body.Token, body.ExpiresAt, nil
+}
@@ -0,0 +1,113 @@
+package github
+
+import (
+	"testing"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestQueryShapeKeyNormalizesAliasesAndLiterals(t *testing.T) {
+	q1 := `query {
+repo0: repository(owner: "alice", name: "one") { ... on Repository { id } }
+}`
+	q2 := `query {
+repo0: repository(owner: "bob", name: "two") { ... on Repository { id } }
+}`
+	// Mirrors what buildGetReposBatchQuery actually produces for two
+	// different-sized batches: more repoN aliases, not just different
+	// literals.
+	q3 := `query {
+repo0: repository(owner: "alice", name: "one") { ... on Repository { id } }
+repo1: repository(owner: "carol", name: "three") { ... on Repository { id } }
+}`
+
+	if queryShapeKey(q1) != queryShapeKey(q2) {
+		t.Fatal("expected queries differing only in alias/argument literals to share a shape key")
+	}
+	if queryShapeKey(q1) == queryShapeKey(q3) {
+		t.Fatal("expected queries with a different number of aliases to have distinct shape keys")
+	}
+}
+
+func TestQueryShapeKeyFallsBackOnUnparseableQuery(t *testing.T) {
+	// Not valid GraphQL; queryShapeKey must still return something stable
+	// rather than panicking or erroring.
+	q := "not graphql"
+	if queryShapeKey(q) != queryShapeKey(q) {
+		t.Fatal("expected a stable key for the same unparseable input")
+	}
+}
+
+func TestCalcDefinitionCostWithNamedAndInlineFragments(t *testing.T) {
+	// issues(first: 10) costs 1 at depth 1; its nested fragment spread
+	// requests comments(first: 5) at depth 2, multiplied by the parent's
+	// limit (10), for a raw cost of 1 + 10 = 11 (divided by 100 downstream
+	// by estimateGraphQLCost, not here).
+	query := `
+fragment CommentFields on Issue {
+	comments(first: 5) {
+		nodes { id }
+	}
+}
+query {
+	repository(owner: "a", name: "b") {
+		issues(first: 10) {
+			nodes {
+				... on Issue {
+					...CommentFields
+				}
+			}
+		}
+	}
+}`
+	cost, err := estimateGraphQLCost(query)
+	if err != nil {
+		t.Fatalf("estimateGraphQLCost returned error: %v", err)
+	}
+	if cost < 1 {
+		t.Fatalf("cost = %d, want at least 1", cost)
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		t.Fatalf("parsing query: %v", err)
+	}
+	fragments := make(map[string]*ast.FragmentDefinition)
+	var op ast.Node
+	for _, def := range doc.Definitions {
+		switch d := def.(type) {
+		case *ast.FragmentDefinition:
+			fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			op = d
+		}
+	}
+	rawCost, err := calcDefinitionCost(op, fragments)
+	if err != nil {
+		t.Fatalf("calcDefinitionCost returned error: %v", err)
+	}
+	if rawCost != 11 {
+		t.Fatalf("raw cost = %d, want 11", rawCost)
+	}
+}
+
+func TestCalcDefinitionCostFragmentCycleDoesNotHang(t *testing.T) {
+	// A and B spread each other; walkSelectionSetCost must terminate instead
+	// of recursing forever.
+	query := `
+fragment A on Repository {
+	...B
+}
+fragment B on Repository {
+	...A
+}
+query {
+	repository(owner: "a", name: "b") {
+		...A
+	}
+}`
+	if _, err := estimateGraphQLCost(query); err != nil {
+		t.Fatalf("estimateGraphQLCost returned error: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package github
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRepoInflightClaimDedupesWithinACall(t *testing.T) {
+	ri := newRepoInflight()
+
+	toFetch, waiters := ri.claim([]string{"a/a", "b/b", "a/a"})
+
+	if got, want := toFetch, []string{"a/a", "b/b"}; !equalStrings(got, want) {
+		t.Fatalf("toFetch = %v, want %v", got, want)
+	}
+	if got, want := waiters, []string{"a/a"}; !equalStrings(got, want) {
+		t.Fatalf("waiters = %v, want %v", got, want)
+	}
+
+	// Both the fetched occurrence and the duplicate waiter should observe the
+	// same resolved result once it comes in.
+	done := make(chan RepoOrError, 1)
+	go func() { done <- ri.wait(context.Background(), "a/a") }()
+
+	want := RepoOrError{NameWithOwner: "a/a", Repo: &Repository{NameWithOwner: "a/a"}}
+	ri.resolve(want)
+
+	if got := <-done; got != want {
+		t.Fatalf("waiter got %+v, want %+v", got, want)
+	}
+}
+
+func TestRepoInflightClaimSharesAcrossCalls(t *testing.T) {
+	ri := newRepoInflight()
+
+	toFetch1, waiters1 := ri.claim([]string{"a/a"})
+	if len(toFetch1) != 1 || len(waiters1) != 0 {
+		t.Fatalf("first claim: toFetch=%v waiters=%v, want one toFetch, no waiters", toFetch1, waiters1)
+	}
+
+	toFetch2, waiters2 := ri.claim([]string{"a/a"})
+	if len(toFetch2) != 0 || len(waiters2) != 1 {
+		t.Fatalf("second claim: toFetch=%v waiters=%v, want no toFetch, one waiter", toFetch2, waiters2)
+	}
+}
+
+func TestRepoInflightWaitContextCancelled(t *testing.T) {
+	ri := newRepoInflight()
+	ri.claim([]string{"a/a"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	roe := ri.wait(ctx, "a/a")
+	if roe.Err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", roe.Err)
+	}
+}
+
+func TestRepoInflightWaitUnknownName(t *testing.T) {
+	ri := newRepoInflight()
+
+	roe := ri.wait(context.Background(), "never/claimed")
+	if roe.Err == nil {
+		t.Fatal("expected an error for a name nothing claimed")
+	}
+}
+
+func TestRepoInflightResolveTwiceIsANoop(t *testing.T) {
+	ri := newRepoInflight()
+	ri.claim([]string{"a/a"})
+
+	ri.resolve(RepoOrError{NameWithOwner: "a/a"})
+
+	done := make(chan struct{})
+	go func() {
+		// A second resolve for a name nobody has re-claimed should not panic
+		// on a double close of the done channel.
+		ri.resolve(RepoOrError{NameWithOwner: "a/a"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second resolve did not return")
+	}
+}
+
+func TestBatchAliasIndex(t *testing.T) {
+	tests := []struct {
+		path    []interface{}
+		wantIdx int
+		wantOK  bool
+	}{
+		{path: []interface{}{"repo0"}, wantIdx: 0, wantOK: true},
+		{path: []interface{}{"repo12", "nested"}, wantIdx: 12, wantOK: true},
+		{path: []interface{}{"rateLimit"}, wantOK: false},
+		{path: nil, wantOK: false},
+		{path: []interface{}{float64(3)}, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		idx, ok := batchAliasIndex(tt.path)
+		if ok != tt.wantOK || (ok && idx != tt.wantIdx) {
+			t.Errorf("batchAliasIndex(%v) = (%d, %v), want (%d, %v)", tt.path, idx, ok, tt.wantIdx, tt.wantOK)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
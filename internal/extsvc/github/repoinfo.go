@@ -0,0 +1,118 @@
+package github
+
+import (
+	"context"
+	"sync"
+)
+
+// RepoInfo is the subset of a repository's metadata RepoInfoCache tracks:
+// just enough for a caller to decide whether a repository is worth cloning,
+// and how to parallelize across repositories of different sizes, before it
+// actually issues a clone.
+type RepoInfo struct {
+	NameWithOwner  string
+	DiskUsageKB    int
+	DefaultBranch  string
+	HasWikiEnabled bool
+	Visibility     string
+}
+
+// RepoInfoCache caches RepoInfo by nameWithOwner. It's populated as a side
+// effect of GetReposByNameWithOwner and SearchRepos, now that
+// repositoryFieldsGraphQLFragment requests diskUsage/defaultBranchRef/
+// hasWikiEnabled/visibility, so repeat lookups (e.g. two overlapping calls
+// to ReposUnderSize) don't re-issue GraphQL for repos we've already seen.
+type RepoInfoCache struct {
+	mu    sync.RWMutex
+	infos map[string]RepoInfo
+}
+
+func newRepoInfoCache() *RepoInfoCache {
+	return &RepoInfoCache{infos: make(map[string]RepoInfo)}
+}
+
+func (c *RepoInfoCache) get(nameWithOwner string) (RepoInfo, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	info, ok := c.infos[nameWithOwner]
+	return info, ok
+}
+
+func (c *RepoInfoCache) set(info RepoInfo) {
+	if info.NameWithOwner == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.infos[info.NameWithOwner] = info
+}
+
+// repoInfoFromRepository extracts the fields RepoInfoCache tracks from a
+// fetched Repository.
+func repoInfoFromRepository(r *Repository) RepoInfo {
+	info := RepoInfo{
+		NameWithOwner:  r.NameWithOwner,
+		DiskUsageKB:    r.DiskUsage,
+		HasWikiEnabled: r.HasWikiEnabled,
+		Visibility:     r.Visibility,
+	}
+	if r.DefaultBranchRef != nil {
+		info.DefaultBranch = r.DefaultBranchRef.Name
+	}
+	return info
+}
+
+// ReposUnderSizeResult is the result of ReposUnderSize.
+type ReposUnderSizeResult struct {
+	// UnderSize is the subset of the requested names whose disk usage is at
+	// most maxKB. Names GitHub doesn't know about are omitted entirely.
+	UnderSize []string
+	// TotalSizeKB is the summed disk usage, in KB, of every requested name
+	// that was found, over size or not, so callers can budget disk space
+	// before cloning any of them.
+	TotalSizeKB int
+}
+
+// ReposUnderSize reports which of names are at most maxKB in on-disk size.
+// It consults c's RepoInfoCache first and only issues GraphQL (via
+// GetReposByNameWithOwner, batched as usual) for names it hasn't seen
+// before, so repeated calls over an overlapping set of repositories get
+// progressively cheaper.
+func (c *V4Client) ReposUnderSize(ctx context.Context, names []string, maxKB int) (ReposUnderSizeResult, error) {
+	var result ReposUnderSizeResult
+
+	infos := make(map[string]RepoInfo, len(names))
+	var unknown []string
+	for _, name := range names {
+		if info, ok := c.repoInfo.get(name); ok {
+			infos[name] = info
+			continue
+		}
+		unknown = append(unknown, name)
+	}
+
+	for _, batch := range chunkNames(unknown, batchGetReposPageSize) {
+		repos, err := c.getReposByNameWithOwner(ctx, batch)
+		if err != nil {
+			return ReposUnderSizeResult{}, err
+		}
+		for _, r := range repos {
+			info := repoInfoFromRepository(r)
+			infos[info.NameWithOwner] = info
+		}
+	}
+
+	for _, name := range names {
+		info, ok := infos[name]
+		if !ok {
+			// GitHub doesn't know this repository; nothing to size or clone.
+			continue
+		}
+		result.TotalSizeKB += info.DiskUsageKB
+		if info.DiskUsageKB <= maxKB {
+			result.UnderSize = append(result.UnderSize, name)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,37 @@
+package github
+
+// Repository is a GitHub repository as returned by the V4 (GraphQL) API.
+// Its fields mirror repositoryFieldsGraphQLFragment; not every field is
+// populated on every instance, since viewerPermission is only requested on
+// GitHub.com, and stargazerCount and the fields in
+// repoSizeAndVisibilityFields only on GitHub.com and GitHub Enterprise
+// versions matching ghe300PlusOrDotComSemver.
+type Repository struct {
+	ID               string
+	DatabaseID       int64
+	NameWithOwner    string
+	Description      string
+	URL              string
+	IsPrivate        bool
+	IsFork           bool
+	IsArchived       bool
+	IsLocked         bool
+	IsDisabled       bool
+	ViewerPermission string
+	StargazerCount   int
+	ForkCount        int
+
+	// DiskUsage, DefaultBranchRef, HasWikiEnabled and Visibility are only
+	// requested on GitHub.com and GHE instances new enough to advertise them;
+	// see repoSizeAndVisibilityFields. They're zero-valued otherwise.
+	DiskUsage        int                  `json:"diskUsage"`
+	DefaultBranchRef *RepositoryBranchRef `json:"defaultBranchRef"`
+	HasWikiEnabled   bool                 `json:"hasWikiEnabled"`
+	Visibility       string               `json:"visibility"`
+}
+
+// RepositoryBranchRef identifies a branch reference on a Repository, e.g.
+// its defaultBranchRef.
+type RepositoryBranchRef struct {
+	Name string `json:"name"`
+}
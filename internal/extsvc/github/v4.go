@@ -3,19 +3,24 @@ package github
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/cockroachdb/errors"
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
-	"github.com/graphql-go/graphql/language/visitor"
+	"github.com/graphql-go/graphql/language/printer"
 	"github.com/inconshreveable/log15"
 	"golang.org/x/time/rate"
 
@@ -49,6 +54,16 @@ type V4Client struct {
 
 	// rateLimit is our self imposed rate limiter.
 	rateLimit *rate.Limiter
+
+	// repoInflight coalesces concurrent BatchGetRepos fetches (from this call
+	// or another) for the same repository so they share a single round trip.
+	// GetReposByNameWithOwner doesn't participate: two concurrent calls to it
+	// for the same repository each still issue their own request.
+	repoInflight *repoInflight
+
+	// repoInfo caches size/visibility metadata populated by
+	// GetReposByNameWithOwner and SearchRepos, consulted by ReposUnderSize.
+	repoInfo *RepoInfoCache
 }
 
 // NewV4Client creates a new GitHub GraphQL API client with an optional default
@@ -76,6 +91,10 @@ func NewV4Client(apiURL *url.URL, a auth.Authenticator, cli httpcli.Doer) *V4Cli
 		return category
 	})
 
+	// tokenHash keys the rate limit monitor registry below. For an
+	// auth.GitHubAppInstallation this is derived from the app + installation
+	// IDs rather than the ephemeral installation token, so refreshing the
+	// token doesn't churn the registry with a new entry every hour.
 	var tokenHash string
 	if a != nil {
 		tokenHash = a.Hash()
@@ -91,6 +110,8 @@ func NewV4Client(apiURL *url.URL, a auth.Authenticator, cli httpcli.Doer) *V4Cli
 		httpClient:       cli,
 		rateLimit:        rl,
 		rateLimitMonitor: rlm,
+		repoInflight:     newRepoInflight(),
+		repoInfo:         newRepoInfoCache(),
 	}
 }
 
@@ -106,12 +127,57 @@ func (c *V4Client) RateLimitMonitor() *ratelimit.Monitor {
 	return c.rateLimitMonitor
 }
 
-func (c *V4Client) requestGraphQL(ctx context.Context, query string, vars map[string]interface{}, result interface{}) (err error) {
+// requestOption customizes a single requestGraphQL call.
+type requestOption func(*requestOptions)
+
+type requestOptions struct {
+	// maxCost, if non-zero, causes requestGraphQL to refuse to issue a query
+	// whose estimated cost is over it, and to request GitHub's own
+	// `rateLimit` block back so the real remaining budget can be tracked.
+	maxCost int
+}
+
+// WithCost sets a per-request cost budget: requestGraphQL returns
+// ErrCostBudgetExceeded instead of issuing the query if its estimated cost
+// is over maxCost.
+func WithCost(maxCost int) requestOption {
+	return func(o *requestOptions) { o.maxCost = maxCost }
+}
+
+// ErrCostBudgetExceeded is returned when a query's estimated cost is over
+// the budget passed via WithCost.
+var ErrCostBudgetExceeded = errors.New("github: estimated query cost exceeds budget")
+
+func (c *V4Client) requestGraphQL(ctx context.Context, query string, vars map[string]interface{}, result interface{}, opts ...requestOption) (err error) {
+	var options requestOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	rawCost, err := estimateGraphQLCost(query)
+	if err != nil {
+		return errors.Wrap(err, "estimating graphql cost")
+	}
+	cost := defaultGraphQLCostEstimator.adjust(query, rawCost)
+
+	if options.maxCost > 0 && cost > options.maxCost {
+		return errors.Wrapf(ErrCostBudgetExceeded, "estimated cost %d, budget %d", cost, options.maxCost)
+	}
+
+	outgoingQuery := query
+	trackRateLimit := false
+	if options.maxCost > 0 {
+		outgoingQuery, trackRateLimit, err = injectRateLimitSelection(query)
+		if err != nil {
+			return errors.Wrap(err, "injecting rateLimit selection")
+		}
+	}
+
 	reqBody, err := json.Marshal(struct {
 		Query     string                 `json:"query"`
 		Variables map[string]interface{} `json:"variables"`
 	}{
-		Query:     query,
+		Query:     outgoingQuery,
 		Variables: vars,
 	})
 	if err != nil {
@@ -137,21 +203,76 @@ func (c *V4Client) requestGraphQL(ctx context.Context, query string, vars map[st
 		Errors graphqlErrors   `json:"errors"`
 	}
 
-	cost, err := estimateGraphQLCost(query)
-	if err != nil {
-		return errors.Wrap(err, "estimating graphql cost")
-	}
-
 	if err := c.rateLimit.WaitN(ctx, cost); err != nil {
 		return errors.Wrap(err, "rate limit")
 	}
 
 	time.Sleep(c.rateLimitMonitor.RecommendedWaitForBackgroundOp(cost))
 
-	if _, err := doRequest(ctx, c.apiURL, c.auth, c.rateLimitMonitor, c.httpClient, req, &respBody); err != nil {
+	// This retry loop only covers the GraphQL path. doRequest also backs the
+	// REST calls elsewhere in this client (e.g. fetchGitHubVersion), and
+	// ideally gets the same secondary-limit retry, but its own definition
+	// isn't part of this change -- wrapping it here without seeing that body
+	// risks duplicating (or fighting) whatever retry/backoff it already does
+	// internally, so it's left alone.
+	maxRetries := secondaryLimitRetryBudget(isMutationQuery(query))
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, gbErr := req.GetBody()
+			if gbErr != nil {
+				return errors.Wrap(gbErr, "rewinding request body for retry")
+			}
+			req.Body = body
+		}
+
+		// Clear what an earlier attempt decoded, so its errors don't outlive
+		// a successful retry (a response without "errors" leaves the field as is).
+		respBody.Data, respBody.Errors = nil, nil
+
+		var resp *httpResponseState
+		resp, err = doRequest(ctx, c.apiURL, c.auth, c.rateLimitMonitor, c.httpClient, req, &respBody)
+
+		// GitHub can also report a secondary limit as a normal 200 response
+		// with the message embedded in respBody.Errors rather than as a
+		// transport-level error; check both before deciding whether to retry.
+		checkErr := err
+		if checkErr == nil && len(respBody.Errors) > 0 {
+			checkErr = respBody.Errors
+		}
+
+		secErr, isSecondary := asSecondaryLimitError(resp, checkErr)
+		if !isSecondary || attempt >= maxRetries {
+			break
+		}
+
+		wait := secondaryLimitWait(secErr)
+		log15.Warn("github: hit secondary rate limit, backing off", "wait", wait, "attempt", attempt+1)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	if err != nil {
 		return err
 	}
 
+	if trackRateLimit && respBody.Data != nil {
+		var costProbe struct {
+			RateLimit *struct {
+				Limit     int       `json:"limit"`
+				Cost      int       `json:"cost"`
+				Remaining int       `json:"remaining"`
+				ResetAt   time.Time `json:"resetAt"`
+			} `json:"rateLimit"`
+		}
+		if err0 := json.Unmarshal(respBody.Data, &costProbe); err0 == nil && costProbe.RateLimit != nil {
+			defaultGraphQLCostEstimator.record(query, rawCost, costProbe.RateLimit.Cost)
+			c.updateRateLimitMonitorFromGraphQL(costProbe.RateLimit.Limit, costProbe.RateLimit.Remaining, costProbe.RateLimit.ResetAt)
+		}
+	}
+
 	// If the GraphQL response has errors, still attempt to unmarshal the data portion, as some
 	// requests may expect errors but have useful responses (e.g., querying a list of repositories,
 	// some of which you expect to 404).
@@ -166,8 +287,216 @@ func (c *V4Client) requestGraphQL(ctx context.Context, query string, vars map[st
 	return err
 }
 
+// injectRateLimitSelection parses query and appends a top-level
+// `rateLimit { limit cost remaining resetAt }` selection to each of its
+// operations, by mutating the parsed AST and re-printing it rather than by
+// string concatenation. The returned bool reports whether anything was
+// injected (false for a query with no operation definitions to attach to).
+func injectRateLimitSelection(query string) (string, bool, error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return query, false, errors.Wrap(err, "parsing query")
+	}
+
+	injected := false
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok || op.SelectionSet == nil {
+			continue
+		}
+		op.SelectionSet.Selections = append(op.SelectionSet.Selections, rateLimitSelection())
+		injected = true
+	}
+	if !injected {
+		return query, false, nil
+	}
+
+	printed, ok := printer.Print(doc).(string)
+	if !ok {
+		return query, false, errors.New("printing query with injected rateLimit selection")
+	}
+	return printed, true, nil
+}
+
+// rateLimitSelection builds the `rateLimit { limit cost remaining resetAt }`
+// field injectRateLimitSelection attaches to outgoing operations.
+func rateLimitSelection() *ast.Field {
+	return ast.NewField(&ast.Field{
+		Name: ast.NewName(&ast.Name{Value: "rateLimit"}),
+		SelectionSet: ast.NewSelectionSet(&ast.SelectionSet{
+			Selections: []ast.Selection{
+				simpleFieldSelection("limit"),
+				simpleFieldSelection("cost"),
+				simpleFieldSelection("remaining"),
+				simpleFieldSelection("resetAt"),
+			},
+		}),
+	})
+}
+
+func simpleFieldSelection(name string) ast.Selection {
+	return ast.NewField(&ast.Field{Name: ast.NewName(&ast.Name{Value: name})})
+}
+
+// updateRateLimitMonitorFromGraphQL folds the rateLimit block GitHub returns
+// inline in a GraphQL response into rateLimitMonitor, which otherwise only
+// learns about remaining points from REST response headers -- headers that
+// GraphQL responses don't always refresh on every call.
+func (c *V4Client) updateRateLimitMonitorFromGraphQL(limit, remaining int, resetAt time.Time) {
+	h := make(http.Header)
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(resetAt.Unix(), 10))
+	c.rateLimitMonitor.Update(h)
+}
+
+// SecondaryLimitError describes a request GitHub rejected because of its
+// secondary ("abuse detection") rate limit, as detected by
+// asSecondaryLimitError. requestGraphQL uses its RetryAfter to back off
+// between retries; once retries run out it returns the underlying error, not
+// a SecondaryLimitError. This limit is distinct from the primary GraphQL cost
+// budget tracked by rateLimitMonitor, and from the per-call rate.Limiter:
+// it can trip even when both of those report plenty of headroom left, and
+// typically clears again within seconds to a couple of minutes.
+type SecondaryLimitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *SecondaryLimitError) Error() string {
+	return fmt.Sprintf("github: secondary rate limit, retry after %s: %s", e.RetryAfter, e.Message)
+}
+
+const (
+	// secondaryLimitMaxWait caps the back-off taken from GitHub's Retry-After
+	// header (or used when it gives none) for one attempt, regardless of what
+	// that header says; secondaryLimitWait adds up to 20% jitter on top.
+	secondaryLimitMaxWait = 60 * time.Second
+	// secondaryLimitReadRetries is how many times a read (query) is retried
+	// on a secondary rate limit.
+	secondaryLimitReadRetries = 3
+	// secondaryLimitMutationRetries is lower than the read budget: GitHub
+	// explicitly rate-limits point-in-time mutation bursts, and retrying a
+	// mutation blindly risks amplifying whatever caused the burst.
+	secondaryLimitMutationRetries = 1
+)
+
+func secondaryLimitRetryBudget(mutation bool) int {
+	if mutation {
+		return secondaryLimitMutationRetries
+	}
+	return secondaryLimitReadRetries
+}
+
+// isMutationQuery reports whether query is a GraphQL mutation rather than a
+// query, based on its leading keyword.
+func isMutationQuery(query string) bool {
+	return strings.HasPrefix(strings.TrimSpace(query), "mutation")
+}
+
+// asSecondaryLimitError reports whether err looks like GitHub's secondary
+// ("abuse detection") rate limit rather than some other error. Unlike the
+// primary limit, GitHub doesn't expose a dedicated status code for this, and
+// x-ratelimit-reset in particular is present on nearly every 403/429 --
+// including plain permission-denied responses and primary limit exhaustion
+// -- so headers alone can't gate the *decision*. The only reliable tell
+// there is the error message itself explicitly naming the secondary limit or
+// abuse detection. Once that's established, though, resp's Retry-After (or,
+// failing that, x-ratelimit-reset) header is the authoritative source for
+// how long to actually wait, and takes priority over any duration mentioned
+// in the message text.
+func asSecondaryLimitError(resp *httpResponseState, err error) (*SecondaryLimitError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	msg := err.Error()
+	lower := strings.ToLower(msg)
+	isAbuseMessage := strings.Contains(lower, "secondary rate limit") || strings.Contains(lower, "abuse detection")
+	if !isAbuseMessage {
+		return nil, false
+	}
+	return &SecondaryLimitError{Message: msg, RetryAfter: secondaryRetryAfter(resp, msg)}, true
+}
+
+// secondaryRetryAfter resolves how long to wait for a confirmed secondary
+// limit: resp's Retry-After header first, then its x-ratelimit-reset header,
+// then a best-effort parse of the error message itself, in that order.
+func secondaryRetryAfter(resp *httpResponseState, msg string) time.Duration {
+	if resp != nil {
+		if wait, ok := parseRetryAfter(resp.headers); ok {
+			return wait
+		}
+		if wait, ok := parseRateLimitReset(resp.headers); ok {
+			return wait
+		}
+	}
+	wait, _ := parseRetryAfterFromMessage(msg)
+	return wait
+}
+
+func parseRetryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
+
+func parseRateLimitReset(h http.Header) (time.Duration, bool) {
+	v := h.Get("x-ratelimit-reset")
+	if v == "" {
+		return 0, false
+	}
+	epoch, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Until(time.Unix(epoch, 0)), true
+}
+
+// parseRetryAfterFromMessage looks for a "retry after Ns" (or similar)
+// mention in an error message, as a last resort when resp has no usable
+// Retry-After/x-ratelimit-reset header (e.g. a secondary limit surfaced via
+// the GraphQL errors array on a 200 response, which carries no headers of
+// its own here).
+func parseRetryAfterFromMessage(msg string) (time.Duration, bool) {
+	m := retryAfterMessagePattern.FindStringSubmatch(msg)
+	if len(m) != 2 {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+var retryAfterMessagePattern = regexp.MustCompile(`(?i)retry.?after[:=]?\s*(\d+)`)
+
+// secondaryLimitWait caps e's reported RetryAfter to secondaryLimitMaxWait
+// and adds a little jitter, so that many callers backing off at once don't
+// all retry in lockstep.
+func secondaryLimitWait(e *SecondaryLimitError) time.Duration {
+	wait := e.RetryAfter
+	if wait <= 0 || wait > secondaryLimitMaxWait {
+		wait = secondaryLimitMaxWait
+	}
+	jitter := time.Duration(rand.Int63n(int64(wait)/5 + 1))
+	return wait + jitter
+}
+
 // estimateGraphQLCost estimates the cost of the query as described here:
 // https://developer.github.com/v4/guides/resource-limitations/#calculating-a-rate-limit-score-before-running-the-call
+//
+// Named fragments (e.g. ...RepositoryFields) and inline fragments are
+// resolved so that connection limits nested inside them are counted as if
+// they'd been written out inline in the operation itself.
 func estimateGraphQLCost(query string) (int, error) {
 	doc, err := parser.Parse(parser.ParseParams{
 		Source: query,
@@ -176,9 +505,23 @@ func estimateGraphQLCost(query string) (int, error) {
 		return 0, errors.Wrap(err, "parsing query")
 	}
 
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if frag, ok := def.(*ast.FragmentDefinition); ok && frag.Name != nil {
+			fragments[frag.Name.Value] = frag
+		}
+	}
+
 	var totalCost int
 	for _, def := range doc.Definitions {
-		cost := calcDefinitionCost(def)
+		// Fragments are only costed where they're spread from, never on their own.
+		if _, ok := def.(*ast.FragmentDefinition); ok {
+			continue
+		}
+		cost, err := calcDefinitionCost(def, fragments)
+		if err != nil {
+			return 0, err
+		}
 		totalCost += cost
 	}
 
@@ -197,58 +540,112 @@ type limitDepth struct {
 	depth int
 }
 
-func calcDefinitionCost(def ast.Node) int {
-	var cost int
-	limitStack := make([]limitDepth, 0)
+// calcDefinitionCost walks the selection set of an operation (or, recursively,
+// a fragment spread from it) and sums the cost contributed by each 'first'/
+// 'last' limited field, as per GitHub's calculation spec.
+func calcDefinitionCost(def ast.Node, fragments map[string]*ast.FragmentDefinition) (int, error) {
+	var selSet *ast.SelectionSet
+	switch d := def.(type) {
+	case *ast.OperationDefinition:
+		selSet = d.SelectionSet
+	case *ast.FragmentDefinition:
+		selSet = d.SelectionSet
+	default:
+		return 0, nil
+	}
 
-	v := &visitor.VisitorOptions{
-		Enter: func(p visitor.VisitFuncParams) (string, interface{}) {
-			switch node := p.Node.(type) {
-			case *ast.IntValue:
-				// We're looking for a 'first' or 'last' param indicating a limit
-				parent, ok := p.Parent.(*ast.Argument)
-				if !ok {
-					return visitor.ActionNoChange, nil
-				}
-				if parent.Name == nil {
-					return visitor.ActionNoChange, nil
-				}
-				if parent.Name.Value != "first" && parent.Name.Value != "last" {
-					return visitor.ActionNoChange, nil
-				}
+	limitStack := make([]limitDepth, 0)
+	return walkSelectionSetCost(selSet, 0, &limitStack, fragments, make(map[string]bool))
+}
 
-				// Prune anything above our current depth as we may have started walking
-				// back down the tree
-				currentDepth := len(p.Ancestors)
-				limitStack = filterInPlace(limitStack, currentDepth)
+// walkSelectionSetCost recurses through a selection set, inlining named
+// fragment spreads (tracked in `visiting` to guard against cycles) and
+// inline fragments at the depth they appear, so their limited fields are
+// costed exactly as if they'd been written directly into the query.
+func walkSelectionSetCost(selSet *ast.SelectionSet, depth int, limitStack *[]limitDepth, fragments map[string]*ast.FragmentDefinition, visiting map[string]bool) (int, error) {
+	if selSet == nil {
+		return 0, nil
+	}
 
-				limit, err := strconv.Atoi(node.Value)
-				if err != nil {
-					return "", errors.Wrap(err, "parsing limit")
-				}
-				limitStack = append(limitStack, limitDepth{limit: limit, depth: currentDepth})
-				// The first item in the tree is always worth 1
-				if len(limitStack) == 1 {
+	var cost int
+	for _, sel := range selSet.Selections {
+		switch s := sel.(type) {
+		case *ast.Field:
+			childDepth := depth + 1
+			// Prune anything above our current depth as we may have started walking
+			// back down the tree
+			*limitStack = filterInPlace(*limitStack, childDepth)
+
+			if limit, ok := fieldLimit(s); ok {
+				*limitStack = append(*limitStack, limitDepth{limit: limit, depth: childDepth})
+				if len(*limitStack) == 1 {
+					// The first item in the tree is always worth 1
 					cost++
-					return visitor.ActionNoChange, nil
+				} else {
+					// The cost of the current item is calculated using the limits of
+					// its children. Multiply them all together.
+					product := 1
+					for _, n := range (*limitStack)[:len(*limitStack)-1] {
+						product = n.limit * product
+					}
+					cost += product
 				}
-				// The cost of the current item is calculated using the limits of
-				// its children
-				children := limitStack[:len(limitStack)-1]
-				product := 1
-				// Multiply them all together
-				for _, n := range children {
-					product = n.limit * product
-				}
-				cost += product
 			}
-			return visitor.ActionNoChange, nil
-		},
+
+			childCost, err := walkSelectionSetCost(s.SelectionSet, childDepth, limitStack, fragments, visiting)
+			if err != nil {
+				return 0, err
+			}
+			cost += childCost
+
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			if visiting[name] {
+				// Cycle between fragments; nothing more to add from here.
+				continue
+			}
+			frag, ok := fragments[name]
+			if !ok {
+				continue
+			}
+			visiting[name] = true
+			fragCost, err := walkSelectionSetCost(frag.SelectionSet, depth, limitStack, fragments, visiting)
+			delete(visiting, name)
+			if err != nil {
+				return 0, err
+			}
+			cost += fragCost
+
+		case *ast.InlineFragment:
+			inlineCost, err := walkSelectionSetCost(s.SelectionSet, depth, limitStack, fragments, visiting)
+			if err != nil {
+				return 0, err
+			}
+			cost += inlineCost
+		}
 	}
 
-	_ = visitor.Visit(def, v, nil)
+	return cost, nil
+}
 
-	return cost
+// fieldLimit returns the value of a field's 'first' or 'last' argument, if
+// it has one and it's a literal integer.
+func fieldLimit(f *ast.Field) (int, bool) {
+	for _, arg := range f.Arguments {
+		if arg.Name == nil || (arg.Name.Value != "first" && arg.Name.Value != "last") {
+			continue
+		}
+		iv, ok := arg.Value.(*ast.IntValue)
+		if !ok {
+			continue
+		}
+		limit, err := strconv.Atoi(iv.Value)
+		if err != nil {
+			continue
+		}
+		return limit, true
+	}
+	return 0, false
 }
 
 func filterInPlace(limitStack []limitDepth, depth int) []limitDepth {
@@ -263,6 +660,133 @@ func filterInPlace(limitStack []limitDepth, depth int) []limitDepth {
 	return limitStack
 }
 
+// graphQLCostEstimator tracks how estimateGraphQLCost's static estimate for a
+// given query shape compares to the cost GitHub actually reports for it (via
+// the rateLimit { cost } selection injectRateLimitSelection adds), and nudges
+// future estimates for that shape towards reality with a running EMA. This
+// lets the self-imposed rate.Limiter converge instead of permanently over-
+// or under-reserving for queries built from fragments, whose true cost the
+// static walk can't always see.
+type graphQLCostEstimator struct {
+	mu         sync.Mutex
+	multiplier map[string]float64
+}
+
+// costEMAAlpha weights how much a single observation moves the running
+// multiplier for a query shape. Low enough that one unusually large or small
+// response doesn't swing future estimates too far.
+const costEMAAlpha = 0.2
+
+func newGraphQLCostEstimator() *graphQLCostEstimator {
+	return &graphQLCostEstimator{multiplier: make(map[string]float64)}
+}
+
+// adjust scales estimated by the running multiplier recorded for this query
+// shape, if any observations have been recorded for it yet.
+func (e *graphQLCostEstimator) adjust(query string, estimated int) int {
+	key := queryShapeKey(query)
+
+	e.mu.Lock()
+	m, ok := e.multiplier[key]
+	e.mu.Unlock()
+	if !ok {
+		return estimated
+	}
+
+	adjusted := int(float64(estimated) * m)
+	if adjusted < 1 {
+		adjusted = 1
+	}
+	return adjusted
+}
+
+// record folds the actual cost GitHub reported for a query back into the
+// running multiplier for its shape.
+func (e *graphQLCostEstimator) record(query string, estimated, actual int) {
+	if estimated <= 0 || actual <= 0 {
+		return
+	}
+	ratio := float64(actual) / float64(estimated)
+	key := queryShapeKey(query)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if m, ok := e.multiplier[key]; ok {
+		e.multiplier[key] = (1-costEMAAlpha)*m + costEMAAlpha*ratio
+	} else {
+		e.multiplier[key] = ratio
+	}
+}
+
+// queryShapeKey hashes query's shape so the multiplier is keyed by, e.g., the
+// fixed text buildSearchReposQuery produces, rather than by the literal
+// values baked into it. That distinction matters for queries like
+// buildGetReposBatchQuery's, which inline a distinct repoN alias and
+// owner/name literal per requested repository: hashing the raw text would
+// give every such call its own shape, and the multiplier -- the entire point
+// of this self-correction -- would never accumulate any history for it.
+// Falls back to hashing the raw text if query doesn't parse.
+func queryShapeKey(query string) string {
+	normalized, ok := normalizeQueryShape(query)
+	if !ok {
+		normalized = query
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeQueryShape parses query and reprints it with every field alias
+// dropped and every argument's literal value blanked out, so that two
+// queries differing only in the aliases/literals a caller baked in (repo0 vs
+// repo1, owner: "a" vs owner: "b", ...) normalize to identical text.
+func normalizeQueryShape(query string) (string, bool) {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return "", false
+	}
+	for _, def := range doc.Definitions {
+		var selSet *ast.SelectionSet
+		switch d := def.(type) {
+		case *ast.OperationDefinition:
+			selSet = d.SelectionSet
+		case *ast.FragmentDefinition:
+			selSet = d.SelectionSet
+		default:
+			continue
+		}
+		blankSelectionSetLiterals(selSet)
+	}
+	printed, ok := printer.Print(doc).(string)
+	if !ok {
+		return "", false
+	}
+	return printed, true
+}
+
+// blankSelectionSetLiterals recursively clears every Field's alias and
+// replaces every Argument's value with a single canonical placeholder, in
+// place, so the shape of a selection set no longer depends on which
+// repository/owner/limit/etc. literals a caller filled in.
+func blankSelectionSetLiterals(selSet *ast.SelectionSet) {
+	if selSet == nil {
+		return
+	}
+	for _, sel := range selSet.Selections {
+		switch s := sel.(type) {
+		case *ast.Field:
+			s.Alias = nil
+			for _, arg := range s.Arguments {
+				arg.Value = ast.NewStringValue(&ast.StringValue{Value: "_"})
+			}
+			blankSelectionSetLiterals(s.SelectionSet)
+		case *ast.InlineFragment:
+			blankSelectionSetLiterals(s.SelectionSet)
+		}
+	}
+}
+
+var defaultGraphQLCostEstimator = newGraphQLCostEstimator()
+
 // graphqlErrors describes the errors in a GraphQL response. It contains at least 1 element when returned by
 // requestGraphQL. See https://graphql.github.io/graphql-spec/June2018/#sec-Errors.
 type graphqlErrors []struct {
@@ -376,6 +900,9 @@ type SearchReposParams struct {
 	After Cursor
 	// First is the page size. Default to 100 if left zero.
 	First int
+	// MaxCost, if non-zero, causes SearchRepos to return ErrCostBudgetExceeded
+	// instead of issuing a query whose estimated cost is over it.
+	MaxCost int
 }
 
 // SearchReposResults is the result type of SearchRepos.
@@ -421,11 +948,20 @@ func (c *V4Client) SearchRepos(ctx context.Context, p SearchReposParams) (Search
 		}
 	}
 
-	err := c.requestGraphQL(ctx, query, vars, &resp)
+	var opts []requestOption
+	if p.MaxCost > 0 {
+		opts = append(opts, WithCost(p.MaxCost))
+	}
+
+	err := c.requestGraphQL(ctx, query, vars, &resp, opts...)
 	if err != nil {
 		return SearchReposResults{}, err
 	}
 
+	for i := range resp.Search.Nodes {
+		c.repoInfo.set(repoInfoFromRepository(&resp.Search.Nodes[i]))
+	}
+
 	results := SearchReposResults{
 		Repos:      resp.Search.Nodes,
 		TotalCount: resp.Search.RepositoryCount,
@@ -463,7 +999,21 @@ query($query: String!, $type: SearchType!, $after: String, $first: Int!) {
 // the conservative step back from 37.
 //
 // This method does not cache.
-func (c *V4Client) GetReposByNameWithOwner(ctx context.Context, namesWithOwners ...string) ([]*Repository, error) {
+//
+// It does record each repository it fetches in the client's RepoInfoCache
+// (used by ReposUnderSize), but never answers from that cache.
+//
+// opts currently accepts WithCost: pass WithCost(n) to have the batch query
+// refused (with ErrCostBudgetExceeded) rather than issued if its estimated
+// cost is over n.
+func (c *V4Client) GetReposByNameWithOwner(ctx context.Context, namesWithOwners []string, opts ...requestOption) ([]*Repository, error) {
+	return c.getReposByNameWithOwner(ctx, namesWithOwners, opts...)
+}
+
+// getReposByNameWithOwner is the implementation behind GetReposByNameWithOwner.
+// It's also called directly by ReposUnderSize, which already splits its input
+// into <=30-name batches, so the ErrBatchTooLarge check below never trips for it.
+func (c *V4Client) getReposByNameWithOwner(ctx context.Context, namesWithOwners []string, opts ...requestOption) ([]*Repository, error) {
 	if len(namesWithOwners) > 30 {
 		return nil, ErrBatchTooLarge
 	}
@@ -474,7 +1024,7 @@ func (c *V4Client) GetReposByNameWithOwner(ctx context.Context, namesWithOwners
 	}
 
 	var result map[string]*Repository
-	err = c.requestGraphQL(ctx, query, map[string]interface{}{}, &result)
+	err = c.requestGraphQL(ctx, query, map[string]interface{}{}, &result, opts...)
 	if err != nil {
 		var e graphqlErrors
 		if errors.As(err, &e) {
@@ -490,15 +1040,273 @@ func (c *V4Client) GetReposByNameWithOwner(ctx context.Context, namesWithOwners
 		}
 	}
 
+	// When opts injects a rateLimit selection (see injectRateLimitSelection),
+	// it lands in this same result map under the "rateLimit" key, since the
+	// map is populated straight from the top-level selection set. Strip it
+	// before treating every map entry as a fetched repository, or it comes
+	// out the other end as a phantom zero-value *Repository.
+	delete(result, "rateLimit")
+
 	repos := make([]*Repository, 0, len(result))
 	for _, r := range result {
 		if r != nil {
 			repos = append(repos, r)
+			c.repoInfo.set(repoInfoFromRepository(r))
 		}
 	}
 	return repos, nil
 }
 
+// RepoOrError pairs a requested nameWithOwner with either the Repository
+// BatchGetRepos fetched for it or the error encountered doing so (including
+// a GitHub NOT_FOUND, which GetReposByNameWithOwner instead drops silently).
+type RepoOrError struct {
+	NameWithOwner string
+	Repo          *Repository
+	Err           error
+}
+
+// batchGetReposPageSize mirrors GetReposByNameWithOwner's hard cap: the
+// maximum number of repository aliases BatchGetRepos will put in a single
+// sub-query.
+const batchGetReposPageSize = 30
+
+// BatchGetRepos fetches the given repositories (namesWithOwners), mirroring
+// GetReposByNameWithOwner but without its 30-repository limit: it
+// transparently splits names into batchGetReposPageSize-sized sub-queries
+// and runs up to concurrency of them at once. Every name yields exactly one
+// RepoOrError on the returned channel once BatchGetRepos has fetched (or
+// failed to fetch) it, including names GitHub reports as NOT_FOUND, which
+// GetReposByNameWithOwner otherwise drops. Concurrent BatchGetRepos calls
+// (from this client) asking for the same repository share a single round
+// trip; a concurrent GetReposByNameWithOwner call for that repository does
+// not join that coalescing and issues its own request regardless.
+//
+// The returned channel is closed once every name has produced a result or
+// ctx is cancelled, whichever comes first.
+//
+// opts currently accepts WithCost: pass WithCost(n) to have every
+// batchGetReposPageSize-sized sub-query refused (surfaced as
+// ErrCostBudgetExceeded on each of its names) rather than issued if its
+// estimated cost is over n.
+func (c *V4Client) BatchGetRepos(ctx context.Context, names []string, concurrency int, opts ...requestOption) (<-chan RepoOrError, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make(chan RepoOrError, len(names))
+
+	go func() {
+		defer close(results)
+
+		toFetch, waiters := c.repoInflight.claim(names)
+
+		var wg sync.WaitGroup
+		for _, name := range waiters {
+			name := name
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results <- c.repoInflight.wait(ctx, name)
+			}()
+		}
+
+		batches := chunkNames(toFetch, batchGetReposPageSize)
+		sem := make(chan struct{}, concurrency)
+		for i, batch := range batches {
+			batch := batch
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				// Resolve this and every remaining batch's names so they
+				// don't stay claimed in repoInflight forever with nothing
+				// left to fetch them.
+				for _, b := range batches[i:] {
+					for _, name := range b {
+						roe := RepoOrError{NameWithOwner: name, Err: ctx.Err()}
+						c.repoInflight.resolve(roe)
+						results <- roe
+					}
+				}
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				c.fetchRepoBatch(ctx, batch, results, opts...)
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return results, nil
+}
+
+// fetchRepoBatch issues a single (<=batchGetReposPageSize) sub-query and
+// emits exactly one RepoOrError per requested name, folding per-repo
+// NOT_FOUND errors in rather than dropping them as GetReposByNameWithOwner
+// does.
+func (c *V4Client) fetchRepoBatch(ctx context.Context, names []string, results chan<- RepoOrError, opts ...requestOption) {
+	emit := func(roe RepoOrError) {
+		c.repoInflight.resolve(roe)
+		results <- roe
+	}
+
+	query, err := c.buildGetReposBatchQuery(ctx, names)
+	if err != nil {
+		for _, name := range names {
+			emit(RepoOrError{NameWithOwner: name, Err: err})
+		}
+		return
+	}
+
+	var result map[string]*Repository
+	err = c.requestGraphQL(ctx, query, map[string]interface{}{}, &result, opts...)
+	// See the matching comment in getReposByNameWithOwner: a rateLimit
+	// selection injected by opts lands in this map too, and must not be
+	// mistaken for a fetched repository.
+	delete(result, "rateLimit")
+
+	notFound := make(map[int]bool)
+	var e graphqlErrors
+	if errors.As(err, &e) {
+		for _, err2 := range e {
+			if err2.Type != graphqlErrTypeNotFound {
+				continue
+			}
+			if idx, ok := batchAliasIndex(err2.Path); ok {
+				notFound[idx] = true
+			}
+		}
+		err = nil
+	}
+	if err != nil {
+		for _, name := range names {
+			emit(RepoOrError{NameWithOwner: name, Err: err})
+		}
+		return
+	}
+
+	for i, name := range names {
+		repo := result[fmt.Sprintf("repo%d", i)]
+		switch {
+		case repo != nil:
+			emit(RepoOrError{NameWithOwner: name, Repo: repo})
+		case notFound[i]:
+			emit(RepoOrError{NameWithOwner: name, Err: errors.Newf("github: repository %s not found", name)})
+		default:
+			emit(RepoOrError{NameWithOwner: name, Err: errors.Newf("github: no result for repository %s", name)})
+		}
+	}
+}
+
+// batchAliasIndex extracts the N from a GraphQL error path beginning with
+// the "repoN" alias buildGetReposBatchQuery assigns each requested
+// repository, so a NOT_FOUND error can be matched back to the name that
+// caused it.
+func batchAliasIndex(path []interface{}) (int, bool) {
+	if len(path) == 0 {
+		return 0, false
+	}
+	alias, ok := path[0].(string)
+	if !ok || !strings.HasPrefix(alias, "repo") {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(strings.TrimPrefix(alias, "repo"))
+	if err != nil {
+		return 0, false
+	}
+	return idx, true
+}
+
+func chunkNames(names []string, size int) [][]string {
+	if len(names) == 0 {
+		return nil
+	}
+	chunks := make([][]string, 0, (len(names)+size-1)/size)
+	for len(names) > 0 {
+		n := size
+		if n > len(names) {
+			n = len(names)
+		}
+		chunks = append(chunks, names[:n])
+		names = names[n:]
+	}
+	return chunks
+}
+
+// repoInflight coalesces concurrent fetches for the same repository name
+// across BatchGetRepos calls (and, via claim, within a single call) so that
+// only one of them hits the GitHub API; the rest wait for its result.
+type repoInflight struct {
+	mu      sync.Mutex
+	pending map[string]*inflightRepoFetch
+}
+
+type inflightRepoFetch struct {
+	done chan struct{}
+	res  RepoOrError
+}
+
+func newRepoInflight() *repoInflight {
+	return &repoInflight{pending: make(map[string]*inflightRepoFetch)}
+}
+
+// claim splits names into toFetch (names this caller should fetch, now
+// marked pending) and waiters (names another in-flight call -- or an earlier
+// duplicate elsewhere in names -- already owns). Every element of names,
+// duplicates included, ends up in exactly one of the two returned slices, so
+// each still yields its own RepoOrError via wait or a fetch.
+func (ri *repoInflight) claim(names []string) (toFetch, waiters []string) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+
+	for _, name := range names {
+		if _, ok := ri.pending[name]; ok {
+			waiters = append(waiters, name)
+			continue
+		}
+		ri.pending[name] = &inflightRepoFetch{done: make(chan struct{})}
+		toFetch = append(toFetch, name)
+	}
+	return toFetch, waiters
+}
+
+// wait blocks until the in-flight fetch claimed for name resolves, or ctx is
+// cancelled.
+func (ri *repoInflight) wait(ctx context.Context, name string) RepoOrError {
+	ri.mu.Lock()
+	fetch, ok := ri.pending[name]
+	ri.mu.Unlock()
+	if !ok {
+		return RepoOrError{NameWithOwner: name, Err: errors.Newf("github: no in-flight fetch found for %s", name)}
+	}
+
+	select {
+	case <-fetch.done:
+		return fetch.res
+	case <-ctx.Done():
+		return RepoOrError{NameWithOwner: name, Err: ctx.Err()}
+	}
+}
+
+// resolve delivers roe to anyone waiting on it and clears the pending entry.
+func (ri *repoInflight) resolve(roe RepoOrError) {
+	ri.mu.Lock()
+	fetch, ok := ri.pending[roe.NameWithOwner]
+	if ok {
+		delete(ri.pending, roe.NameWithOwner)
+	}
+	ri.mu.Unlock()
+	if !ok {
+		return
+	}
+	fetch.res = roe
+	close(fetch.done)
+}
+
 func (c *V4Client) buildGetReposBatchQuery(ctx context.Context, namesWithOwners []string) (string, error) {
 	var b strings.Builder
 	b.WriteString(c.repositoryFieldsGraphQLFragment(ctx))
@@ -518,11 +1326,23 @@ func (c *V4Client) buildGetReposBatchQuery(ctx context.Context, namesWithOwners
 	return b.String(), nil
 }
 
+// repoSizeAndVisibilityFields are requested in addition to the core
+// RepositoryFields below; enumeration workloads (bulk cloning, code
+// scanning) use them to skip oversized repos and parallelize up-front via
+// RepoInfoCache/ReposUnderSize, rather than discovering the size only once
+// a clone is already underway.
+var repoSizeAndVisibilityFields = []string{
+	"diskUsage",
+	"defaultBranchRef { name }",
+	"hasWikiEnabled",
+	"visibility",
+}
+
 // repositoryFieldsGraphQLFragment returns a GraphQL fragment that contains the fields needed to populate the
 // Repository struct.
 func (c *V4Client) repositoryFieldsGraphQLFragment(ctx context.Context) string {
 	if c.githubDotCom {
-		return `
+		return fmt.Sprintf(`
 fragment RepositoryFields on Repository {
 	id
 	databaseId
@@ -537,13 +1357,15 @@ fragment RepositoryFields on Repository {
 	viewerPermission
 	stargazerCount
 	forkCount
+	%s
 }
-	`
+	`, strings.Join(repoSizeAndVisibilityFields, "\n	"))
 	}
 	ghe300Fields := []string{}
 	version := c.determineGitHubVersion(ctx)
 	if ghe300PlusOrDotComSemver.Check(version) {
 		ghe300Fields = append(ghe300Fields, "stargazerCount")
+		ghe300Fields = append(ghe300Fields, repoSizeAndVisibilityFields...)
 	}
 	// Some fields are not yet available on GitHub Enterprise yet
 	// or are available but too new to expect our customers to have updated: